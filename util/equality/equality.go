@@ -15,197 +15,366 @@ package equality
 
 import (
 	operatorv1alpha1 "github.com/projectcontour/contour-operator/api/v1alpha1"
+	"github.com/projectcontour/contour-operator/util/equality/merge"
 
 	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
-	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-// DaemonsetConfigChanged checks if current and expected DaemonSet match,
-// and if not, returns the updated DaemonSet resource.
-func DaemonsetConfigChanged(current, expected *appsv1.DaemonSet) (*appsv1.DaemonSet, bool) {
-	changed := false
-	updated := current.DeepCopy()
-
-	if !apiequality.Semantic.DeepEqual(current.Labels, expected.Labels) {
-		changed = true
-		updated.Labels = expected.Labels
-
+// mergeDaemonsetSpec three-way merges expected's Spec onto dst, preserving
+// any fields dst carries that the operator itself didn't last set.
+func mergeDaemonsetSpec(dst, expected *appsv1.DaemonSet, ignoreFields ...string) {
+	// Decode into a fresh value: reusing dst.Spec would share its slices and maps.
+	var merged appsv1.DaemonSetSpec
+	if err := merge.Spec(dst, &merged, dst.Spec, expected.Spec, ignoreFields...); err != nil {
+		dst.Spec = expected.Spec
+		return
 	}
+	dst.Spec = merged
+}
 
-	if !apiequality.Semantic.DeepEqual(current.Spec, expected.Spec) {
-		changed = true
-		updated.Spec = expected.Spec
+// daemonsetProperties returns the properties DaemonsetConfigChanged reconciles.
+func daemonsetProperties() []Property {
+	return []Property{
+		{
+			Path:   "metadata.labels",
+			Getter: func(obj client.Object) interface{} { return obj.(*appsv1.DaemonSet).Labels },
+			Setter: func(dst, src client.Object) { dst.(*appsv1.DaemonSet).Labels = src.(*appsv1.DaemonSet).Labels },
+		},
+		{
+			Path:   "spec",
+			Getter: func(obj client.Object) interface{} { return obj.(*appsv1.DaemonSet).Spec },
+			Setter: func(dst, src client.Object) {
+				mergeDaemonsetSpec(dst.(*appsv1.DaemonSet), src.(*appsv1.DaemonSet))
+			},
+		},
 	}
+}
 
+// DaemonsetConfigChanged checks if current and expected DaemonSet match, and
+// if not, returns the updated DaemonSet resource and a human-readable
+// changeset describing what changed, suitable for logging or Kubernetes
+// events.
+func DaemonsetConfigChanged(current, expected *appsv1.DaemonSet) (*appsv1.DaemonSet, bool, []string) {
+	updated, changed, changeset := ReconcileWithHash(current, expected, daemonsetProperties())
 	if !changed {
-		return nil, false
+		return nil, false, nil
 	}
 
-	return updated, true
+	return updated.(*appsv1.DaemonSet), true, changeset
 }
 
-// JobConfigChanged checks if the current and expected Job match and if not,
-// returns true and the expected job.
-func JobConfigChanged(current, expected *batchv1.Job) (*batchv1.Job, bool) {
-	changed := false
-	updated := current.DeepCopy()
-
-	if !apiequality.Semantic.DeepEqual(current.Labels, expected.Labels) {
-		updated = expected
-		changed = true
-	}
-
-	if !apiequality.Semantic.DeepEqual(current.Spec.Parallelism, expected.Spec.Parallelism) {
-		updated = expected
-		changed = true
-	}
-
-	if !apiequality.Semantic.DeepEqual(current.Spec.BackoffLimit, expected.Spec.BackoffLimit) {
-		updated = expected
-		changed = true
-	}
-
-	// The completions field is immutable, so no need to compare. Ignore job-generated
-	// labels and only check the presence of the contour owning label.
-	if current.Spec.Template.Labels != nil {
-		if _, ok := current.Spec.Template.Labels[operatorv1alpha1.OwningContourLabel]; !ok {
-			updated = expected
-			changed = true
-		}
+// mergeJobPodSpec three-way merges expected's pod template spec onto dst,
+// preserving any fields dst carries that the operator itself didn't last set.
+func mergeJobPodSpec(dst, expected *batchv1.Job, ignoreFields ...string) {
+	// Decode into a fresh value: reusing dst's pod spec would share its slices and maps.
+	var merged corev1.PodSpec
+	if err := merge.Spec(dst, &merged, dst.Spec.Template.Spec, expected.Spec.Template.Spec, ignoreFields...); err != nil {
+		dst.Spec.Template.Spec = expected.Spec.Template.Spec
+		return
 	}
+	dst.Spec.Template.Spec = merged
+}
 
-	if !apiequality.Semantic.DeepEqual(current.Spec.Template.Spec, expected.Spec.Template.Spec) {
-		updated = expected
-		changed = true
+// jobProperties returns the properties JobConfigChanged reconciles.
+func jobProperties() []Property {
+	return []Property{
+		{
+			Path:   "metadata.labels",
+			Getter: func(obj client.Object) interface{} { return obj.(*batchv1.Job).Labels },
+			Setter: func(dst, src client.Object) { dst.(*batchv1.Job).Labels = src.(*batchv1.Job).Labels },
+		},
+		{
+			Path:   "spec.parallelism",
+			Getter: func(obj client.Object) interface{} { return obj.(*batchv1.Job).Spec.Parallelism },
+			Setter: func(dst, src client.Object) {
+				dst.(*batchv1.Job).Spec.Parallelism = src.(*batchv1.Job).Spec.Parallelism
+			},
+		},
+		{
+			Path:   "spec.backoffLimit",
+			Getter: func(obj client.Object) interface{} { return obj.(*batchv1.Job).Spec.BackoffLimit },
+			Setter: func(dst, src client.Object) {
+				dst.(*batchv1.Job).Spec.BackoffLimit = src.(*batchv1.Job).Spec.BackoffLimit
+			},
+		},
+		// The completions field is immutable, so no need to compare. Ignore
+		// job-generated labels and only check the presence of the contour
+		// owning label.
+		{
+			Path: "spec.template.metadata.labels[" + operatorv1alpha1.OwningContourLabel + "]",
+			Getter: func(obj client.Object) interface{} {
+				_, ok := obj.(*batchv1.Job).Spec.Template.Labels[operatorv1alpha1.OwningContourLabel]
+				return ok
+			},
+			// Only the labels are copied here, not the whole template: the
+			// spec.template.spec property below three-way merges
+			// Spec.Template.Spec against dst's current value, and a wholesale
+			// template replace here would run first and stomp that baseline.
+			Setter: func(dst, src client.Object) {
+				dst.(*batchv1.Job).Spec.Template.Labels = src.(*batchv1.Job).Spec.Template.Labels
+			},
+		},
+		{
+			Path:   "spec.template.spec",
+			Getter: func(obj client.Object) interface{} { return obj.(*batchv1.Job).Spec.Template.Spec },
+			Setter: func(dst, src client.Object) {
+				mergeJobPodSpec(dst.(*batchv1.Job), src.(*batchv1.Job))
+			},
+		},
 	}
+}
 
+// JobConfigChanged checks if the current and expected Job match and if not,
+// returns the updated Job and a human-readable changeset describing what
+// changed, suitable for logging or Kubernetes events.
+func JobConfigChanged(current, expected *batchv1.Job) (*batchv1.Job, bool, []string) {
+	updated, changed, changeset := ReconcileWithHash(current, expected, jobProperties())
 	if !changed {
-		return nil, false
+		return nil, false, nil
 	}
 
-	return updated, true
+	return updated.(*batchv1.Job), true, changeset
 }
 
-// DeploymentConfigChanged checks if the current and expected Deployment match
-// and if not, returns true and the expected Deployment.
-func DeploymentConfigChanged(current, expected *appsv1.Deployment) (*appsv1.Deployment, bool) {
-	changed := false
-	updated := current.DeepCopy()
-
-	if !apiequality.Semantic.DeepEqual(current.Labels, expected.Labels) {
-		updated = expected
-		changed = true
+// mergeDeploymentSpec three-way merges expected's Spec onto dst, preserving
+// any fields dst carries that the operator itself didn't last set.
+func mergeDeploymentSpec(dst, expected *appsv1.Deployment, ignoreFields ...string) {
+	// Decode into a fresh value: reusing dst.Spec would share its slices and maps.
+	var merged appsv1.DeploymentSpec
+	if err := merge.Spec(dst, &merged, dst.Spec, expected.Spec, ignoreFields...); err != nil {
+		dst.Spec = expected.Spec
+		return
 	}
+	dst.Spec = merged
+}
 
-	if !apiequality.Semantic.DeepEqual(current.Spec, expected.Spec) {
-		updated = expected
-		changed = true
+// deploymentProperties returns the properties DeploymentConfigChanged
+// reconciles.
+func deploymentProperties() []Property {
+	return []Property{
+		{
+			Path:   "metadata.labels",
+			Getter: func(obj client.Object) interface{} { return obj.(*appsv1.Deployment).Labels },
+			Setter: func(dst, src client.Object) { dst.(*appsv1.Deployment).Labels = src.(*appsv1.Deployment).Labels },
+		},
+		{
+			Path:   "spec",
+			Getter: func(obj client.Object) interface{} { return obj.(*appsv1.Deployment).Spec },
+			Setter: func(dst, src client.Object) {
+				mergeDeploymentSpec(dst.(*appsv1.Deployment), src.(*appsv1.Deployment))
+			},
+		},
 	}
+}
 
+// DeploymentConfigChanged checks if the current and expected Deployment
+// match, and if not, returns the updated Deployment and a human-readable
+// changeset describing what changed, suitable for logging or Kubernetes
+// events.
+//
+// This always reconciles Spec.Replicas, which will fight an attached
+// HorizontalPodAutoscaler: an HPA-aware mode needs a
+// spec.envoyDeployment.autoscaling.enabled-style field on the Contour CRD so
+// callers have a real switch to pass through, and the code that builds the
+// "expected" Deployment would need to stop stamping Replicas when it's set.
+// Neither exists in this checkout, so that mode isn't implemented here;
+// HPAConfigChanged below reconciles a HorizontalPodAutoscaler object on its
+// own terms in the meantime, independent of how its target Deployment is
+// reconciled.
+func DeploymentConfigChanged(current, expected *appsv1.Deployment) (*appsv1.Deployment, bool, []string) {
+	updated, changed, changeset := ReconcileWithHash(current, expected, deploymentProperties())
 	if !changed {
-		return nil, false
+		return nil, false, nil
 	}
 
-	return updated, true
+	return updated.(*appsv1.Deployment), true, changeset
 }
 
-// ClusterIpServiceChanged checks if the spec of current and expected match and if not,
-// returns true and the expected Service resource. The cluster IP is not compared
-// as it's assumed to be dynamically assigned.
-func ClusterIpServiceChanged(current, expected *corev1.Service) (*corev1.Service, bool) {
-	changed := false
-	updated := current.DeepCopy()
-
-	// Spec can't simply be matched since clusterIP is being dynamically assigned.
-	if len(current.Spec.Ports) != len(expected.Spec.Ports) {
-		updated.Spec.Ports = expected.Spec.Ports
-		changed = true
-	} else {
-		if !apiequality.Semantic.DeepEqual(current.Spec.Ports, expected.Spec.Ports) {
-			updated.Spec.Ports = expected.Spec.Ports
-			changed = true
-		}
+// hpaProperties returns the properties HPAConfigChanged reconciles.
+// ScaleTargetRef is immutable once the HPA is created, so it isn't one of
+// them.
+func hpaProperties() []Property {
+	return []Property{
+		{
+			Path: "metadata.labels",
+			Getter: func(obj client.Object) interface{} {
+				return obj.(*autoscalingv2beta2.HorizontalPodAutoscaler).Labels
+			},
+			Setter: func(dst, src client.Object) {
+				dst.(*autoscalingv2beta2.HorizontalPodAutoscaler).Labels = src.(*autoscalingv2beta2.HorizontalPodAutoscaler).Labels
+			},
+		},
+		{
+			Path: "spec.minReplicas",
+			Getter: func(obj client.Object) interface{} {
+				return obj.(*autoscalingv2beta2.HorizontalPodAutoscaler).Spec.MinReplicas
+			},
+			Setter: func(dst, src client.Object) {
+				dst.(*autoscalingv2beta2.HorizontalPodAutoscaler).Spec.MinReplicas = src.(*autoscalingv2beta2.HorizontalPodAutoscaler).Spec.MinReplicas
+			},
+		},
+		{
+			Path: "spec.maxReplicas",
+			Getter: func(obj client.Object) interface{} {
+				return obj.(*autoscalingv2beta2.HorizontalPodAutoscaler).Spec.MaxReplicas
+			},
+			Setter: func(dst, src client.Object) {
+				dst.(*autoscalingv2beta2.HorizontalPodAutoscaler).Spec.MaxReplicas = src.(*autoscalingv2beta2.HorizontalPodAutoscaler).Spec.MaxReplicas
+			},
+		},
+		{
+			Path: "spec.metrics",
+			Getter: func(obj client.Object) interface{} {
+				return obj.(*autoscalingv2beta2.HorizontalPodAutoscaler).Spec.Metrics
+			},
+			Setter: func(dst, src client.Object) {
+				dst.(*autoscalingv2beta2.HorizontalPodAutoscaler).Spec.Metrics = src.(*autoscalingv2beta2.HorizontalPodAutoscaler).Spec.Metrics
+			},
+		},
 	}
+}
 
-	if !apiequality.Semantic.DeepEqual(current.Spec.Selector, expected.Spec.Selector) {
-		updated.Spec.Selector = expected.Spec.Selector
-		changed = true
+// HPAConfigChanged checks if the current and expected HorizontalPodAutoscaler
+// match and if not, returns the updated HPA resource and a human-readable
+// changeset describing what changed, suitable for logging or Kubernetes
+// events.
+func HPAConfigChanged(current, expected *autoscalingv2beta2.HorizontalPodAutoscaler) (*autoscalingv2beta2.HorizontalPodAutoscaler, bool, []string) {
+	updated, changed, changeset := ReconcileWithHash(current, expected, hpaProperties())
+	if !changed {
+		return nil, false, nil
 	}
 
-	if !apiequality.Semantic.DeepEqual(current.Spec.SessionAffinity, expected.Spec.SessionAffinity) {
-		updated.Spec.SessionAffinity = expected.Spec.SessionAffinity
-		changed = true
+	return updated.(*autoscalingv2beta2.HorizontalPodAutoscaler), true, changeset
+}
+
+// mergeServiceSpec three-way merges expected's Spec onto dst, preserving any
+// fields dst carries that the operator itself didn't last set, e.g. an extra
+// port injected by a service mesh sidecar, or a selector label a human added
+// by hand. clusterIP is always left out since it's dynamically assigned.
+func mergeServiceSpec(dst, expected *corev1.Service, ignoreFields ...string) {
+	// Decode into a fresh value: reusing dst.Spec would share its slices and maps.
+	var merged corev1.ServiceSpec
+	if err := merge.Spec(dst, &merged, dst.Spec, expected.Spec, append(ignoreFields, "clusterIP")...); err != nil {
+		dst.Spec = expected.Spec
+		return
 	}
+	dst.Spec = merged
+}
 
-	if !apiequality.Semantic.DeepEqual(current.Spec.Type, expected.Spec.Type) {
-		updated.Spec.Type = expected.Spec.Type
-		changed = true
+// clusterIpServiceProperties returns the properties ClusterIpServiceChanged
+// reconciles: the whole Spec except clusterIP, modeled as a single
+// "spec" property (like deploymentProperties and daemonsetProperties) rather
+// than one per field. mergeServiceSpec three-way merges the whole Spec in one
+// pass; splitting it across several properties that each ran that same merge
+// independently made Reconcile's changeset under-report whenever more than
+// one field actually changed, since the first property's merge would also
+// resolve the others before the walk got to them. The cluster IP is left out
+// of the comparison since it's assumed to be dynamically assigned.
+func clusterIpServiceProperties() []Property {
+	return []Property{
+		{
+			Path: "spec",
+			Getter: func(obj client.Object) interface{} {
+				spec := obj.(*corev1.Service).Spec
+				spec.ClusterIP = ""
+				return spec
+			},
+			Setter: func(dst, src client.Object) {
+				mergeServiceSpec(dst.(*corev1.Service), src.(*corev1.Service))
+			},
+		},
 	}
+}
 
+// ClusterIpServiceChanged checks if the spec of current and expected match
+// and if not, returns the updated Service resource and a human-readable
+// changeset describing what changed, suitable for logging or Kubernetes
+// events. The cluster IP is not compared as it's assumed to be dynamically
+// assigned.
+func ClusterIpServiceChanged(current, expected *corev1.Service) (*corev1.Service, bool, []string) {
+	updated, changed, changeset := ReconcileWithHash(current, expected, clusterIpServiceProperties())
 	if !changed {
-		return nil, false
+		return nil, false, nil
 	}
 
-	return updated, true
+	return updated.(*corev1.Service), true, changeset
 }
 
-// LoadBalancerServiceChanged checks if the spec of current and expected match and if not,
-// returns true and the expected Service resource. The healthCheckNodePort and a port's
-// nodePort are not compared since they are dynamically assigned.
-func LoadBalancerServiceChanged(current, expected *corev1.Service) (*corev1.Service, bool) {
-	changed := false
-	updated := current.DeepCopy()
+// loadBalancerServiceProperties returns the properties LoadBalancerServiceChanged
+// reconciles: the whole Spec except clusterIP, modeled as a single "spec"
+// property for the same reason as clusterIpServiceProperties. The dynamic
+// per-port NodePort, healthCheckNodePort, and loadBalancerIP values are
+// backfilled onto expected by mergeDynamicLoadBalancerFields before this ever
+// runs, so an explicit operator-set value for any of them still wins while an
+// absent one doesn't get clobbered back to zero.
+func loadBalancerServiceProperties() []Property {
+	return []Property{
+		{
+			Path: "spec",
+			Getter: func(obj client.Object) interface{} {
+				spec := obj.(*corev1.Service).Spec
+				spec.ClusterIP = ""
+				return spec
+			},
+			Setter: func(dst, src client.Object) {
+				mergeServiceSpec(dst.(*corev1.Service), src.(*corev1.Service))
+			},
+		},
+	}
+}
 
-	// Ports can't simply be matched since some fields are being dynamically assigned.
-	if len(current.Spec.Ports) != len(expected.Spec.Ports) {
-		updated.Spec.Ports = expected.Spec.Ports
-		changed = true
-	} else {
-		for i, p := range current.Spec.Ports {
-			if !apiequality.Semantic.DeepEqual(p.Name, expected.Spec.Ports[i].Name) {
-				updated.Spec.Ports[i].Name = expected.Spec.Ports[i].Name
-				changed = true
-			}
-			if !apiequality.Semantic.DeepEqual(p.Protocol, expected.Spec.Ports[i].Protocol) {
-				updated.Spec.Ports[i].Protocol = expected.Spec.Ports[i].Protocol
-				changed = true
-			}
-			if !apiequality.Semantic.DeepEqual(p.Port, expected.Spec.Ports[i].Port) {
-				updated.Spec.Ports[i].Port = expected.Spec.Ports[i].Port
-				changed = true
-			}
-			if !apiequality.Semantic.DeepEqual(p.TargetPort, expected.Spec.Ports[i].TargetPort) {
-				updated.Spec.Ports[i].TargetPort = expected.Spec.Ports[i].TargetPort
-				changed = true
+// mergeDynamicLoadBalancerFields returns a copy of expected with its Ports,
+// HealthCheckNodePort, and LoadBalancerIP backfilled from current wherever
+// expected leaves them unset, since those fields are dynamically assigned by
+// the cloud provider and shouldn't be clobbered back to zero/empty.
+func mergeDynamicLoadBalancerFields(current, expected *corev1.Service) *corev1.Service {
+	merged := expected.DeepCopy()
+
+	// Ports can't simply be matched positionally since the API server
+	// dynamically assigns NodePort. Match merged ports to current ports by
+	// (Port, Protocol) and carry over the assigned NodePort whenever merged
+	// leaves it unset, so a diff caused only by the cloud provider filling in
+	// NodePort isn't reapplied.
+	for i, p := range merged.Spec.Ports {
+		if p.NodePort != 0 {
+			continue
+		}
+		for _, cp := range current.Spec.Ports {
+			if cp.Port == p.Port && cp.Protocol == p.Protocol {
+				merged.Spec.Ports[i].NodePort = cp.NodePort
+				break
 			}
 		}
 	}
 
-	if !apiequality.Semantic.DeepEqual(current.Spec.Selector, expected.Spec.Selector) {
-		updated.Spec.Selector = expected.Spec.Selector
-		changed = true
+	if merged.Spec.HealthCheckNodePort == 0 {
+		merged.Spec.HealthCheckNodePort = current.Spec.HealthCheckNodePort
 	}
 
-	if !apiequality.Semantic.DeepEqual(current.Spec.ExternalTrafficPolicy, expected.Spec.ExternalTrafficPolicy) {
-		updated.Spec.ExternalTrafficPolicy = expected.Spec.ExternalTrafficPolicy
-		changed = true
+	if merged.Spec.LoadBalancerIP == "" {
+		merged.Spec.LoadBalancerIP = current.Spec.LoadBalancerIP
 	}
 
-	if !apiequality.Semantic.DeepEqual(current.Spec.SessionAffinity, expected.Spec.SessionAffinity) {
-		updated.Spec.SessionAffinity = expected.Spec.SessionAffinity
-		changed = true
-	}
+	return merged
+}
 
-	if !apiequality.Semantic.DeepEqual(current.Spec.Type, expected.Spec.Type) {
-		updated.Spec.Type = expected.Spec.Type
-		changed = true
-	}
+// LoadBalancerServiceChanged checks if the spec of current and expected
+// match, and if not, returns the updated Service resource and a
+// human-readable changeset describing what changed, suitable for logging or
+// Kubernetes events. Since they are dynamically assigned, a port's nodePort,
+// healthCheckNodePort, and loadBalancerIP are taken from current wherever
+// expected leaves them unset; a value expected sets is compared and applied.
+func LoadBalancerServiceChanged(current, expected *corev1.Service) (*corev1.Service, bool, []string) {
+	merged := mergeDynamicLoadBalancerFields(current, expected)
 
+	updated, changed, changeset := ReconcileWithHash(current, merged, loadBalancerServiceProperties())
 	if !changed {
-		return nil, false
+		return nil, false, nil
 	}
 
-	return updated, true
+	return updated.(*corev1.Service), true, changeset
 }
@@ -0,0 +1,74 @@
+// Copyright Project Contour Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hash computes stable content hashes for the managed objects in
+// util/equality, so a reconcile can detect "nothing meaningful changed"
+// without walking every field.
+package hash
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// SpecAnnotation is the annotation the operator stamps on managed objects
+// with the hash of the spec fields it last reconciled, so a later reconcile
+// can short-circuit the full field-by-field comparison when nothing
+// meaningful has changed.
+const SpecAnnotation = "operator.projectcontour.io/spec-hash"
+
+// VerifiedAtAnnotation records, as an RFC 3339 timestamp, the last time a
+// full field-by-field reconcile actually walked a managed object rather than
+// trusting a matching SpecAnnotation. A hash match alone can't detect an
+// out-of-band edit to the live object (kubectl edit, an admission webhook,
+// ...), since SpecAnnotation is computed from expected, not current;
+// ReconcileWithHash uses this annotation to force a full walk at least every
+// ResyncInterval so that kind of drift still gets caught between changes to
+// the operator's own desired state.
+const VerifiedAtAnnotation = "operator.projectcontour.io/spec-hash-verified-at"
+
+// ResyncInterval is the longest ReconcileWithHash will trust a matching
+// SpecAnnotation before forcing a full comparison again.
+const ResyncInterval = time.Hour
+
+// Compute returns a stable hash of the canonical JSON encoding of v. v is
+// expected to be the "meaningful" subset of a managed object's spec, i.e.
+// only the fields that are actually reconciled.
+func Compute(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.FormatUint(xxhash.Sum64(data), 16), nil
+}
+
+// VerifiedAt formats now for stamping as VerifiedAtAnnotation.
+func VerifiedAt(now time.Time) string {
+	return now.UTC().Format(time.RFC3339)
+}
+
+// Stale reports whether a VerifiedAtAnnotation value of verifiedAt is older
+// than ResyncInterval as of now. An empty or unparseable value (never
+// stamped) counts as stale.
+func Stale(verifiedAt string, now time.Time) bool {
+	t, err := time.Parse(time.RFC3339, verifiedAt)
+	if err != nil {
+		return true
+	}
+
+	return now.Sub(t) > ResyncInterval
+}
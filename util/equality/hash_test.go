@@ -0,0 +1,166 @@
+// Copyright Project Contour Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package equality
+
+import (
+	"testing"
+	"time"
+
+	"github.com/projectcontour/contour-operator/util/equality/hash"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func benchDeployment(mutate func(*appsv1.Deployment)) *appsv1.Deployment {
+	replicas := int32(2)
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "contour",
+			Namespace: "projectcontour",
+			Labels:    map[string]string{"app": "contour"},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{"app": "contour"},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:  "contour",
+							Image: "ghcr.io/projectcontour/contour:main",
+						},
+					},
+				},
+			},
+		},
+	}
+	if mutate != nil {
+		mutate(dep)
+	}
+	return dep
+}
+
+func TestDeploymentConfigChangedHashShortCircuit(t *testing.T) {
+	expected := benchDeployment(nil)
+	current := benchDeployment(nil)
+
+	specHash, err := SpecHash(expected, deploymentProperties())
+	if err != nil {
+		t.Fatalf("SpecHash: %v", err)
+	}
+	current.Annotations = map[string]string{
+		hash.SpecAnnotation:       specHash,
+		hash.VerifiedAtAnnotation: hash.VerifiedAt(time.Now()),
+	}
+	// Drift the field-by-field state without touching the stamped hash, to
+	// prove the hash comparison is actually what's short-circuiting the walk.
+	current.Spec.Template.Spec.Containers[0].Image = "drifted"
+
+	if _, changed, _ := DeploymentConfigChanged(current, expected); changed {
+		t.Fatal("expected a fresh matching hash annotation to short-circuit the comparison")
+	}
+}
+
+// TestDeploymentConfigChangedHashResync proves the short-circuit in
+// TestDeploymentConfigChangedHashShortCircuit doesn't hide drift forever: once
+// VerifiedAtAnnotation is older than hash.ResyncInterval, the same matching
+// SpecAnnotation no longer short-circuits the walk, so an out-of-band edit to
+// current gets caught and corrected.
+func TestDeploymentConfigChangedHashResync(t *testing.T) {
+	expected := benchDeployment(nil)
+	current := benchDeployment(nil)
+
+	specHash, err := SpecHash(expected, deploymentProperties())
+	if err != nil {
+		t.Fatalf("SpecHash: %v", err)
+	}
+	current.Annotations = map[string]string{
+		hash.SpecAnnotation:       specHash,
+		hash.VerifiedAtAnnotation: hash.VerifiedAt(time.Now().Add(-2 * hash.ResyncInterval)),
+	}
+	current.Spec.Template.Spec.Containers[0].Image = "drifted"
+
+	updated, changed, _ := DeploymentConfigChanged(current, expected)
+	if !changed {
+		t.Fatal("expected a stale verified-at annotation to force a full walk that catches the drift")
+	}
+	if got := updated.Spec.Template.Spec.Containers[0].Image; got != "ghcr.io/projectcontour/contour:main" {
+		t.Errorf("expected the drifted image to be corrected back to expected, got %q", got)
+	}
+}
+
+// TestDeploymentConfigChangedHashResyncRefreshesWithNoDrift proves a stale
+// verified-at annotation that finds nothing to fix still bumps
+// VerifiedAtAnnotation, so a quiet Deployment doesn't force a full walk on
+// every single reconcile once its resync window first lapses.
+func TestDeploymentConfigChangedHashResyncRefreshesWithNoDrift(t *testing.T) {
+	expected := benchDeployment(nil)
+	current := benchDeployment(nil)
+
+	specHash, err := SpecHash(expected, deploymentProperties())
+	if err != nil {
+		t.Fatalf("SpecHash: %v", err)
+	}
+	staleVerifiedAt := hash.VerifiedAt(time.Now().Add(-2 * hash.ResyncInterval))
+	current.Annotations = map[string]string{
+		hash.SpecAnnotation:       specHash,
+		hash.VerifiedAtAnnotation: staleVerifiedAt,
+	}
+
+	updated, changed, _ := DeploymentConfigChanged(current, expected)
+	if !changed {
+		t.Fatal("expected the stale resync to still report a change so the refreshed annotation gets written")
+	}
+	if got := updated.Annotations[hash.VerifiedAtAnnotation]; got == staleVerifiedAt {
+		t.Error("expected VerifiedAtAnnotation to be refreshed, got the same stale value")
+	}
+}
+
+// BenchmarkDeploymentConfigChanged compares the steady-state cost of
+// reconciling a Deployment whose hash annotation already matches expected
+// against one that doesn't, to demonstrate the win from chunk0-3's
+// short-circuit.
+func BenchmarkDeploymentConfigChanged(b *testing.B) {
+	expected := benchDeployment(nil)
+
+	b.Run("HashHit", func(b *testing.B) {
+		current := benchDeployment(nil)
+		specHash, err := SpecHash(expected, deploymentProperties())
+		if err != nil {
+			b.Fatalf("SpecHash: %v", err)
+		}
+		current.Annotations = map[string]string{
+			hash.SpecAnnotation:       specHash,
+			hash.VerifiedAtAnnotation: hash.VerifiedAt(time.Now()),
+		}
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			DeploymentConfigChanged(current, expected)
+		}
+	})
+
+	b.Run("HashMiss", func(b *testing.B) {
+		current := benchDeployment(nil)
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			DeploymentConfigChanged(current, expected)
+		}
+	})
+}
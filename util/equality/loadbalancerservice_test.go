@@ -0,0 +1,102 @@
+// Copyright Project Contour Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package equality
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func lbService(mutate func(*corev1.Service)) *corev1.Service {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "envoy",
+			Namespace: "projectcontour",
+		},
+		Spec: corev1.ServiceSpec{
+			Type: corev1.ServiceTypeLoadBalancer,
+			Ports: []corev1.ServicePort{
+				{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, TargetPort: intstr.FromInt(8080)},
+				{Name: "https", Protocol: corev1.ProtocolTCP, Port: 443, TargetPort: intstr.FromInt(8443)},
+			},
+			Selector:        map[string]string{"app": "envoy"},
+			SessionAffinity: corev1.ServiceAffinityNone,
+		},
+	}
+	if mutate != nil {
+		mutate(svc)
+	}
+	return svc
+}
+
+// TestLoadBalancerServiceChangedPreservesCloudAssignedFields simulates
+// re-reconciling after the cloud provider has filled in NodePort,
+// HealthCheckNodePort, and LoadBalancerIP on the live Service: the operator's
+// desired Service still leaves those fields unset, and reconciling against
+// that shouldn't produce a spurious update that strips them back out.
+func TestLoadBalancerServiceChangedPreservesCloudAssignedFields(t *testing.T) {
+	current := lbService(func(s *corev1.Service) {
+		s.Spec.Ports[0].NodePort = 30080
+		s.Spec.Ports[1].NodePort = 30443
+		s.Spec.HealthCheckNodePort = 30100
+		s.Spec.LoadBalancerIP = "203.0.113.10"
+	})
+	expected := lbService(nil)
+
+	updated, changed, _ := LoadBalancerServiceChanged(current, expected)
+	if changed {
+		t.Fatalf("expected no change after cloud provider mutation, got updated=%#v", updated)
+	}
+}
+
+func TestLoadBalancerServiceChangedDetectsRealDiff(t *testing.T) {
+	current := lbService(func(s *corev1.Service) {
+		s.Spec.Ports[0].NodePort = 30080
+		s.Spec.Ports[1].NodePort = 30443
+	})
+	expected := lbService(func(s *corev1.Service) {
+		s.Spec.Selector = map[string]string{"app": "envoy", "new": "label"}
+	})
+
+	updated, changed, _ := LoadBalancerServiceChanged(current, expected)
+	if !changed {
+		t.Fatal("expected a change when the selector differs")
+	}
+	if updated.Spec.Selector["new"] != "label" {
+		t.Errorf("expected updated selector to pick up the new label, got %v", updated.Spec.Selector)
+	}
+	if updated.Spec.Ports[0].NodePort != 30080 || updated.Spec.Ports[1].NodePort != 30443 {
+		t.Errorf("expected cloud-assigned NodePorts to survive an unrelated change, got %#v", updated.Spec.Ports)
+	}
+}
+
+func TestLoadBalancerServiceChangedExplicitOverrideWins(t *testing.T) {
+	current := lbService(func(s *corev1.Service) {
+		s.Spec.LoadBalancerIP = "203.0.113.10"
+	})
+	expected := lbService(func(s *corev1.Service) {
+		s.Spec.LoadBalancerIP = "203.0.113.99"
+	})
+
+	updated, changed, _ := LoadBalancerServiceChanged(current, expected)
+	if !changed {
+		t.Fatal("expected a change when the operator explicitly sets a new LoadBalancerIP")
+	}
+	if updated.Spec.LoadBalancerIP != "203.0.113.99" {
+		t.Errorf("expected explicit LoadBalancerIP to win, got %q", updated.Spec.LoadBalancerIP)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright Project Contour Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package merge three-way merges a managed object's spec so that fields
+// added by something other than the operator (an admission webhook, a
+// service mesh sidecar injector, a human operator, an HPA) survive
+// reconciliation instead of being wholesale replaced.
+package merge
+
+import (
+	"encoding/json"
+
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// LastAppliedAnnotation records the JSON of the spec the operator last wrote,
+// so the next reconcile has a baseline ("original") to diff the live object
+// ("current") and the newly desired object ("expected") against.
+const LastAppliedAnnotation = "contour.operator/last-applied-configuration"
+
+// LastApplied returns the JSON stored in obj's LastAppliedAnnotation, and
+// whether the annotation was present.
+func LastApplied(obj client.Object) ([]byte, bool) {
+	v, ok := obj.GetAnnotations()[LastAppliedAnnotation]
+	if !ok {
+		return nil, false
+	}
+
+	return []byte(v), true
+}
+
+// SetLastApplied stamps obj's LastAppliedAnnotation with the JSON encoding of
+// spec.
+func SetLastApplied(obj client.Object, spec interface{}) error {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[LastAppliedAnnotation] = string(data)
+	obj.SetAnnotations(annotations)
+
+	return nil
+}
+
+// Spec three-way merges current and expected into dst, a pointer to a value
+// of the same type as current and expected. The merge is computed the same
+// way `kubectl apply` computes one: a strategic merge patch between the
+// operator's last-applied spec (falling back to current if obj has none yet)
+// and expected is calculated, then applied on top of current. That means a
+// field expected doesn't mention is left alone unless the operator itself
+// last set it, so foreign additions to current survive.
+//
+// ignoreFields drops top-level JSON fields (e.g. "replicas") from the
+// computed patch before it's applied, for fields that are known to be
+// managed by something other than the operator's desired-state generator.
+//
+// On success, obj's LastAppliedAnnotation is updated to expected, so the next
+// merge has an accurate baseline. dst is left unmodified on error.
+func Spec(obj client.Object, dst interface{}, current, expected interface{}, ignoreFields ...string) error {
+	currentJSON, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+
+	modifiedJSON, err := json.Marshal(expected)
+	if err != nil {
+		return err
+	}
+
+	originalJSON, ok := LastApplied(obj)
+	if !ok {
+		originalJSON = currentJSON
+	}
+
+	patch, err := strategicpatch.CreateThreeWayMergePatch(originalJSON, modifiedJSON, currentJSON, dst, true)
+	if err != nil {
+		return err
+	}
+
+	if len(ignoreFields) > 0 {
+		if patch, err = dropFields(patch, ignoreFields); err != nil {
+			return err
+		}
+	}
+
+	mergedJSON, err := strategicpatch.StrategicMergePatch(currentJSON, patch, dst)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(mergedJSON, dst); err != nil {
+		return err
+	}
+
+	return SetLastApplied(obj, expected)
+}
+
+// dropFields removes the named top-level fields from a JSON merge patch.
+func dropFields(patch []byte, fields []string) ([]byte, error) {
+	var m map[string]interface{}
+	if err := json.Unmarshal(patch, &m); err != nil {
+		return nil, err
+	}
+
+	for _, f := range fields {
+		delete(m, f)
+	}
+
+	return json.Marshal(m)
+}
@@ -0,0 +1,88 @@
+// Copyright Project Contour Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package equality
+
+import (
+	"testing"
+
+	"github.com/projectcontour/contour-operator/util/equality/merge"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// TestDeploymentConfigChangedPreservesForeignTolerations simulates the
+// operator having already recorded a last-applied baseline at creation time,
+// something outside the operator (an admission webhook) adding a toleration
+// it never asked for, and then the operator reconciling again with an
+// unrelated, real change. The foreign toleration must survive alongside the
+// operator's own change.
+func TestDeploymentConfigChangedPreservesForeignTolerations(t *testing.T) {
+	current := benchDeployment(nil)
+	if err := merge.SetLastApplied(current, current.Spec); err != nil {
+		t.Fatalf("SetLastApplied: %v", err)
+	}
+	current.Spec.Template.Spec.Tolerations = []corev1.Toleration{
+		{Key: "webhook-injected", Operator: corev1.TolerationOpExists},
+	}
+
+	expected := benchDeployment(nil)
+	expected.Spec.Template.Spec.Containers[0].Image = "ghcr.io/projectcontour/contour:v2"
+
+	updated, changed, _ := DeploymentConfigChanged(current, expected)
+	if !changed {
+		t.Fatal("expected the image change to be detected")
+	}
+	if got := updated.Spec.Template.Spec.Containers[0].Image; got != "ghcr.io/projectcontour/contour:v2" {
+		t.Errorf("expected the operator's image change to apply, got %q", got)
+	}
+	if len(updated.Spec.Template.Spec.Tolerations) != 1 || updated.Spec.Template.Spec.Tolerations[0].Key != "webhook-injected" {
+		t.Errorf("expected the foreign toleration to survive reconciliation, got %#v", updated.Spec.Template.Spec.Tolerations)
+	}
+}
+
+// TestClusterIpServiceChangedPreservesForeignSelectorLabel is the Service
+// analog: a human adds an extra selector label by hand after the operator's
+// last-applied baseline is recorded, and a later reconcile with a real,
+// unrelated change must not strip it back out.
+func TestClusterIpServiceChangedPreservesForeignSelectorLabel(t *testing.T) {
+	current := &corev1.Service{
+		Spec: corev1.ServiceSpec{
+			Type:     corev1.ServiceTypeClusterIP,
+			Ports:    []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80}},
+			Selector: map[string]string{"app": "contour"},
+		},
+	}
+	if err := merge.SetLastApplied(current, current.Spec); err != nil {
+		t.Fatalf("SetLastApplied: %v", err)
+	}
+	current.Spec.Selector["operated-by-human"] = "true"
+
+	expected := current.DeepCopy()
+	delete(expected.Spec.Selector, "operated-by-human")
+	expected.Spec.Ports[0].Port = 8080
+
+	updated, changed, changeset := ClusterIpServiceChanged(current, expected)
+	if !changed {
+		t.Fatal("expected the port change to be detected")
+	}
+	if got := updated.Spec.Ports[0].Port; got != 8080 {
+		t.Errorf("expected the operator's port change to apply, got %d", got)
+	}
+	if updated.Spec.Selector["operated-by-human"] != "true" {
+		t.Errorf("expected the foreign selector label to survive reconciliation, got %#v", updated.Spec.Selector)
+	}
+	if len(changeset) != 1 {
+		t.Errorf("expected a single spec changeset entry, got %#v", changeset)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright Project Contour Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package equality
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/projectcontour/contour-operator/util/equality/hash"
+
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Property describes a single field, or group of fields, that a *ConfigChanged
+// helper reconciles between the current and expected state of a managed
+// object. Adding support for a new resource kind, or a new field on an
+// existing one, should only require building a []Property, not writing a new
+// comparator by hand.
+type Property struct {
+	// Path is a human-readable, dotted path to the field, used only to
+	// render changeset entries, e.g. "spec.replicas".
+	Path string
+
+	// Getter returns the current value of the property for obj.
+	Getter func(obj client.Object) interface{}
+
+	// Setter copies the property's value from src to dst.
+	Setter func(dst, src client.Object)
+
+	// IgnoreIfZero, when true, skips reconciling this property if the value
+	// Getter returns for expected is the zero value for its type, e.g. to
+	// leave a dynamically-assigned field alone until expected sets it.
+	IgnoreIfZero bool
+}
+
+// Reconcile walks props, comparing the value each returns for current against
+// the value it returns for expected. Any property that differs has its
+// Setter invoked on a deep copy of current, but whether that property counts
+// as changed is decided by comparing the value Getter returns afterwards
+// against its pre-Setter value, not the raw current/expected values: a Setter
+// is allowed to do more than a wholesale copy (e.g. a three-way merge that
+// folds in foreign fields), and may legitimately leave the property's
+// observable value unchanged even though current and expected disagreed. It
+// returns the updated object, whether anything actually changed, and a
+// human-readable changeset describing each modified property, suitable for
+// logging or Kubernetes events. When nothing changed, updated is nil and
+// changed is false.
+func Reconcile(current, expected client.Object, props []Property) (updated client.Object, changed bool, changeset []string) {
+	updated = current.DeepCopyObject().(client.Object)
+
+	for _, prop := range props {
+		beforeVal := prop.Getter(updated)
+		expectedVal := prop.Getter(expected)
+
+		if prop.IgnoreIfZero && isZeroValue(expectedVal) {
+			continue
+		}
+
+		if apiequality.Semantic.DeepEqual(beforeVal, expectedVal) {
+			continue
+		}
+
+		prop.Setter(updated, expected)
+
+		afterVal := prop.Getter(updated)
+		if apiequality.Semantic.DeepEqual(beforeVal, afterVal) {
+			continue
+		}
+
+		changeset = append(changeset, fmt.Sprintf("%s: %v -> %v", prop.Path, beforeVal, afterVal))
+		changed = true
+	}
+
+	if !changed {
+		return nil, false, nil
+	}
+
+	return updated, true, changeset
+}
+
+// isZeroValue reports whether v is the zero value for its underlying type.
+func isZeroValue(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	return rv.IsZero()
+}
+
+// SpecHash returns a stable hash over the values props extract from obj,
+// suitable for stamping on obj as the hash.SpecAnnotation change-detection
+// shortcut.
+func SpecHash(obj client.Object, props []Property) (string, error) {
+	values := make(map[string]interface{}, len(props))
+	for _, prop := range props {
+		values[prop.Path] = prop.Getter(obj)
+	}
+
+	return hash.Compute(values)
+}
+
+// ReconcileWithHash behaves like Reconcile, but first compares the
+// hash.SpecAnnotation stamped on current against a freshly computed hash of
+// expected, skipping the full property walk when they match and the match
+// was itself verified within hash.ResyncInterval. When the walk does find a
+// change, the returned object is stamped with expected's hash and the
+// current time so the next reconcile can take the fast path again. When the
+// walk finds no change, changed is false, except where the hash matched but
+// its verification was stale: then a copy of current with a refreshed
+// hash.VerifiedAtAnnotation is returned as changed.
+//
+// A hash match alone can't tell whether current has drifted out-of-band
+// since it was last written (kubectl edit, an admission webhook, ...):
+// hash.SpecAnnotation is computed only from expected, so it stays valid
+// however much current changes underneath it. hash.VerifiedAtAnnotation
+// bounds how long that's trusted for: once it's older than
+// hash.ResyncInterval, a full walk runs regardless of whether the hash
+// matches, so self-healing drift correction still happens periodically even
+// when the operator's own desired state hasn't changed.
+func ReconcileWithHash(current, expected client.Object, props []Property) (updated client.Object, changed bool, changeset []string) {
+	expectedHash, err := SpecHash(expected, props)
+	now := time.Now()
+
+	if err == nil {
+		annotations := current.GetAnnotations()
+		if annotations[hash.SpecAnnotation] == expectedHash && !hash.Stale(annotations[hash.VerifiedAtAnnotation], now) {
+			return nil, false, nil
+		}
+	}
+
+	updated, changed, changeset = Reconcile(current, expected, props)
+
+	if !changed {
+		if err != nil || current.GetAnnotations()[hash.SpecAnnotation] != expectedHash {
+			return nil, false, nil
+		}
+
+		// The hash matched and the full walk found no drift, but the resync
+		// window had expired (or was never stamped): refresh VerifiedAtAnnotation so the next
+		// hash.ResyncInterval starts now, rather than forcing a full walk on
+		// every subsequent reconcile until expected next changes.
+		updated = current.DeepCopyObject().(client.Object)
+		stampHash(updated, expectedHash, now)
+		return updated, true, []string{"resync: refreshed " + hash.VerifiedAtAnnotation}
+	}
+
+	if err == nil {
+		stampHash(updated, expectedHash, now)
+	}
+
+	return updated, true, changeset
+}
+
+// stampHash records expectedHash and now on obj's annotations, so
+// ReconcileWithHash's short-circuit can be trusted again until
+// hash.ResyncInterval elapses.
+func stampHash(obj client.Object, expectedHash string, now time.Time) {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[hash.SpecAnnotation] = expectedHash
+	annotations[hash.VerifiedAtAnnotation] = hash.VerifiedAt(now)
+	obj.SetAnnotations(annotations)
+}
@@ -0,0 +1,52 @@
+// Copyright Project Contour Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package equality
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// TestClusterIpServiceChangedAppliesSimultaneousFieldChanges covers
+// clusterIpServiceProperties modeling the whole Service Spec as a single
+// property: when ports and selector both differ in the same reconcile, both
+// changes need to land in updated, not just the first one Reconcile happens
+// to look at.
+func TestClusterIpServiceChangedAppliesSimultaneousFieldChanges(t *testing.T) {
+	current := &corev1.Service{
+		Spec: corev1.ServiceSpec{
+			Type:     corev1.ServiceTypeClusterIP,
+			Ports:    []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80}},
+			Selector: map[string]string{"app": "contour"},
+		},
+	}
+	expected := current.DeepCopy()
+	expected.Spec.Ports[0].Port = 8080
+	expected.Spec.Selector = map[string]string{"app": "contour", "new": "label"}
+
+	updated, changed, changeset := ClusterIpServiceChanged(current, expected)
+	if !changed {
+		t.Fatal("expected a change when both ports and selector differ")
+	}
+	if got := updated.Spec.Ports[0].Port; got != 8080 {
+		t.Errorf("expected the port change to apply, got %d", got)
+	}
+	if got := updated.Spec.Selector["new"]; got != "label" {
+		t.Errorf("expected the selector change to apply, got %#v", updated.Spec.Selector)
+	}
+	if len(changeset) != 1 {
+		t.Errorf("expected a single spec changeset entry covering both fields, got %#v", changeset)
+	}
+}